@@ -3,6 +3,7 @@ package mindy
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -11,19 +12,35 @@ import (
 )
 
 type Client struct {
-	Addr   string
-	client *http.Client
+	Addr      string
+	TLSConfig *tls.Config // non-nil enables HTTPS when talking to mindy.
+	client    *http.Client
 }
 
-func (c *Client) Post(r *Request) (*bufio.Scanner, error) {
+func (c *Client) httpClient() *http.Client {
 	if c.client == nil {
-		c.client = http.DefaultClient
+		if c.TLSConfig != nil {
+			c.client = &http.Client{Transport: &http.Transport{TLSClientConfig: c.TLSConfig}}
+		} else {
+			c.client = http.DefaultClient
+		}
+	}
+	return c.client
+}
+
+func (c *Client) scheme() string {
+	if c.TLSConfig != nil {
+		return "https"
 	}
+	return "http"
+}
+
+func (c *Client) Post(r *Request) (*bufio.Scanner, error) {
 	bod, err := json.Marshal(r)
 	if err != nil {
 		return nil, errors.Wrap(err, "encoding request")
 	}
-	resp, err := c.client.Post("http://"+c.Addr+"/mindy", "application/json", bytes.NewBuffer(bod))
+	resp, err := c.httpClient().Post(c.scheme()+"://"+c.Addr+"/mindy", "application/json", bytes.NewBuffer(bod))
 	if err != nil {
 		return nil, errors.Wrap(err, "making request")
 	}
@@ -34,3 +51,24 @@ func (c *Client) Post(r *Request) (*bufio.Scanner, error) {
 	bs := bufio.NewScanner(resp.Body)
 	return bs, nil
 }
+
+// Import sends records to mindy's /mindy/import endpoint as newline-delimited
+// JSON, for mindy to shard and import into the appropriate Pilosa index.
+func (c *Client) Import(records []ImportRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return errors.Wrap(err, "encoding import record")
+		}
+	}
+	resp, err := c.httpClient().Post(c.scheme()+"://"+c.Addr+"/mindy/import", "application/x-ndjson", &buf)
+	if err != nil {
+		return errors.Wrap(err, "making import request")
+	}
+	if resp.StatusCode > 299 {
+		bod, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("unexpected response status code: %d. body: %v", resp.StatusCode, string(bod))
+	}
+	return nil
+}
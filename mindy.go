@@ -4,18 +4,35 @@
 // 1. the set of indexes to query.
 // 2. a list of row,frame pairs to include.
 // 3. a list of row,frame pairs to exclude.
-// 4. the conjunction (AND or OR) which determines whether it will be an Intersect or Union respectively.
+// 4. the conjunction (AND, OR or XOR) which determines whether it will be an
+//    Intersect, Union or Xor respectively.
+// Includes/Excludes entries may also express a range-encoded field
+// comparison, or nest an entire Request as a Group, to build arbitrary
+// boolean trees.
 package mindy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/pilosa/go-pilosa"
 	"github.com/pkg/errors"
@@ -23,22 +40,51 @@ import (
 
 // Main holds the exported options and some unexported state for mindy.
 type Main struct {
-	Pilosa      []string `help:"Comma separated list of pilosa hosts/ports."`
-	Bind        string   `help:"Host/port to bind to."`
-	Concurrency int      `help:"Maximum number of simultaneous Pilosa requests."`
-	s           *http.Server
-	ln          net.Listener
+	Pilosa          []string      `help:"Comma separated list of pilosa hosts/ports. May include https:// and IPv6 addresses."`
+	Bind            string        `help:"Host/port to bind to."`
+	Concurrency     int           `help:"Maximum number of simultaneous Pilosa requests."`
+	TLSCertPath     string        `help:"Path to a certificate for serving /mindy over HTTPS."`
+	TLSKeyPath      string        `help:"Path to the private key matching TLSCertPath."`
+	TLSCAPath       string        `help:"Path to a CA certificate bundle used to verify Pilosa's TLS certificate."`
+	TLSSkipVerify   bool          `help:"Skip verification of Pilosa's TLS certificate."`
+	SlicesMaxTTL    time.Duration `help:"How long to cache the result of Pilosa's /slices/max before refreshing it."`
+	ImportBatchSize int           `help:"Maximum number of bits sent to Pilosa per import request."`
+	s               *http.Server
+	ln              net.Listener
 }
 
 // NewMain returns a Main with the default options.
 func NewMain() *Main {
 	return &Main{
-		Pilosa:      []string{"localhost:10101"},
-		Bind:        ":10001",
-		Concurrency: 2,
+		Pilosa:          []string{"localhost:10101"},
+		Bind:            ":10001",
+		Concurrency:     2,
+		SlicesMaxTTL:    10 * time.Second,
+		ImportBatchSize: defaultImportBatchSize,
 	}
 }
 
+// pilosaTLSConfig builds the *tls.Config used when dialing Pilosa, returning
+// nil if the defaults (verify using the system cert pool) are fine.
+func (m *Main) pilosaTLSConfig() (*tls.Config, error) {
+	if m.TLSCAPath == "" && !m.TLSSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: m.TLSSkipVerify}
+	if m.TLSCAPath != "" {
+		ca, err := ioutil.ReadFile(m.TLSCAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading TLS CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificates found in %s", m.TLSCAPath)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
 // Run starts the mindy server and only returns if there is an error.
 func (m *Main) Run() error {
 	err := m.listen()
@@ -51,23 +97,47 @@ func (m *Main) Run() error {
 
 // serve starts mindy's http server - it does not return unless there is an error.
 func (m *Main) serve() error {
-	return m.s.Serve(tcpKeepAliveListener{m.ln.(*net.TCPListener)})
+	var ln net.Listener = tcpKeepAliveListener{m.ln.(*net.TCPListener)}
+	if m.TLSCertPath != "" || m.TLSKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(m.TLSCertPath, m.TLSKeyPath)
+		if err != nil {
+			return errors.Wrap(err, "loading TLS certificate")
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	return m.s.Serve(ln)
 }
 
 // listen calls listen on the bind port so that the OS will accept new
 // connections. It returns immediately.
 func (m *Main) listen() error {
-	client, err := pilosa.NewClientFromAddresses(m.Pilosa, nil)
+	tlsConfig, err := m.pilosaTLSConfig()
+	if err != nil {
+		return errors.Wrap(err, "building Pilosa TLS config")
+	}
+	client, err := pilosa.NewClientFromAddresses(m.Pilosa, &pilosa.ClientOptions{TLSConfig: tlsConfig})
 	if err != nil {
 		return errors.Wrap(err, "creating Pilosa client")
 	}
+	slicesMaxTTL := m.SlicesMaxTTL
+	if slicesMaxTTL <= 0 {
+		slicesMaxTTL = 10 * time.Second
+	}
+	importBatchSize := m.ImportBatchSize
+	if importBatchSize <= 0 {
+		importBatchSize = defaultImportBatchSize
+	}
 	h := &Handler{
-		client: client,
-		sem:    make(semaphore, m.Concurrency), // length of semaphore is number of concurrent goroutines querying pilosa.
+		client:          client,
+		concurrency:     m.Concurrency,
+		slicesMaxTTL:    slicesMaxTTL,
+		importBatchSize: importBatchSize,
 	}
 
 	sm := http.NewServeMux()
 	sm.HandleFunc("/mindy", h.handleMindy)
+	sm.HandleFunc("/mindy/refresh", h.handleRefresh)
+	sm.HandleFunc("/mindy/import", h.handleImport)
 	m.s = &http.Server{
 		Addr:    m.Bind,
 		Handler: sm,
@@ -79,33 +149,77 @@ func (m *Main) listen() error {
 	return errors.Wrap(err, "starting listener")
 }
 
-// Request defines the structure of a request to mindy.
+// Request defines the structure of a request to mindy. Conjunction is one of
+// "and", "or" or "xor", applied across Includes, with Excludes subtracted
+// from the result via Difference.
+//
+// Mode selects how results are returned: "bits" (the default) streams
+// matching index,col pairs, "count" returns per-index and grand-total
+// counts, and "topn" streams the merged top TopN rows (by count; 10 if TopN
+// is unset) of TopNFrame for each index.
 type Request struct {
 	Indexes     []string `json:"indexes"`
 	Includes    []Row    `json:"includes"`
 	Excludes    []Row    `json:"excludes"`
 	Conjunction string   `json:"conjunction"`
+
+	Mode      string `json:"mode,omitempty"`
+	TopN      int    `json:"topn,omitempty"`
+	TopNFrame string `json:"topnFrame,omitempty"`
 }
 
-// Row specifies a single Pilosa row (given an index name).
+// Row specifies a single node in an Includes/Excludes tree. It is either:
+//   - a plain bitmap row, identified by ID and Frame,
+//   - a range-encoded field query, identified by Frame, Field and Op (one of
+//     "<", "<=", ">", ">=", "==" or "><") against Value (or ValueMin/ValueMax
+//     for "><"). "!=" is rejected: go-pilosa has no native field inequality
+//     query, or
+//   - a nested boolean subtree, given by Group, in which case ID/Frame/Field
+//     are ignored.
 type Row struct {
-	ID    uint64 `json:"id"`
-	Frame string `json:"frame"`
-}
+	ID    uint64 `json:"id,omitempty"`
+	Frame string `json:"frame,omitempty"`
 
-type semaphore chan struct{}
+	Field    string `json:"field,omitempty"`
+	Op       string `json:"op,omitempty"`
+	Value    int    `json:"value,omitempty"`
+	ValueMin int    `json:"valueMin,omitempty"`
+	ValueMax int    `json:"valueMax,omitempty"`
 
-func (s semaphore) Acquire() {
-	s <- struct{}{}
+	Group *Request `json:"group,omitempty"`
 }
 
-func (s semaphore) Release() {
-	<-s
+type Handler struct {
+	client          *pilosa.Client
+	concurrency     int
+	importBatchSize int
+
+	slicesMaxTTL time.Duration
+	slicesMaxSF  singleflight.Group
+	slicesMaxMu  sync.Mutex
+	slicesMax    map[string]uint64
+	slicesMaxAt  time.Time
 }
 
-type Handler struct {
-	client *pilosa.Client
-	sem    semaphore
+// invalidateSlicesMax drops the cached SlicesMax result, forcing the next
+// call to SlicesMax to hit Pilosa.
+func (h *Handler) invalidateSlicesMax() {
+	h.slicesMaxMu.Lock()
+	h.slicesMax = nil
+	h.slicesMaxMu.Unlock()
+}
+
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "must POST to /mindy/refresh", http.StatusMethodNotAllowed)
+		return
+	}
+	h.invalidateSlicesMax()
+	if _, err := h.SlicesMax(); err != nil {
+		http.Error(w, "refreshing slices max: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) handleMindy(w http.ResponseWriter, r *http.Request) {
@@ -121,14 +235,107 @@ func (h *Handler) handleMindy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Query(w, req)
+	err = h.Query(r.Context(), w, req)
 	if err != nil {
 		http.Error(w, "querying pilosa: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (h *Handler) Query(w io.Writer, r *Request) error {
+// Query runs r against Pilosa and writes the results to w, in the format
+// determined by r.Mode. It stops issuing further Pilosa requests as soon as
+// ctx is canceled or a sibling worker fails.
+func (h *Handler) Query(ctx context.Context, w io.Writer, r *Request) error {
+	switch r.Mode {
+	case "", "bits":
+		return h.queryBits(ctx, w, r)
+	case "count":
+		return h.queryCount(ctx, w, r)
+	case "topn":
+		return h.queryTopN(ctx, w, r)
+	default:
+		return fmt.Errorf("invalid mode: %s", r.Mode)
+	}
+}
+
+// sliceJob is one (index, slice) unit of work to run against Pilosa.
+type sliceJob struct {
+	index string
+	qry   pilosa.PQLQuery
+	slice uint64
+}
+
+// resultsBufferSize bounds the results channel used by queryBits, so a slow
+// writer applies backpressure to the worker pool instead of letting
+// it buffer an unbounded number of results in memory.
+const resultsBufferSize = 1024
+
+// runSliceJobs runs jobs across a fixed pool of h.concurrency workers,
+// calling process with each job's single Pilosa result. The first error from
+// either a query or process cancels ctx, so idle workers stop picking up new
+// jobs instead of each completing a full Pilosa round trip before the error
+// is observed.
+func (h *Handler) runSliceJobs(ctx context.Context, jobs []sliceJob, process func(job sliceJob, result *pilosa.QueryResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobCh := make(chan sliceJob)
+	go func() {
+		defer close(jobCh)
+		for _, j := range jobs {
+			select {
+			case jobCh <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	workers := h.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var eg errgroup.Group
+	for w := 0; w < workers; w++ {
+		eg.Go(func() error {
+			for j := range jobCh {
+				result, err := h.sliceQuery(ctx, j.qry, j.slice)
+				if err != nil {
+					cancel()
+					return errors.Wrapf(err, "querying index %s", j.index)
+				}
+				if err := process(j, result); err != nil {
+					cancel()
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// sliceQuery executes qry against a single slice in Pilosa, returning its
+// single result. It aborts early if ctx is already canceled.
+func (h *Handler) sliceQuery(ctx context.Context, qry pilosa.PQLQuery, slice uint64) (*pilosa.QueryResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	response, err := h.client.Query(qry, &pilosa.QueryOptions{Slices: []uint64{slice}})
+	if err != nil {
+		return nil, fmt.Errorf("querying slice %d: %v", slice, err)
+	}
+	// Since this isn't a batch query, there should be exactly one result.
+	if len(response.ResultList) != 1 {
+		return nil, fmt.Errorf("expected 1 result but got %d", len(response.ResultList))
+	}
+	return response.ResultList[0], nil
+}
+
+// queryBits streams matching index,col pairs as CSV.
+func (h *Handler) queryBits(ctx context.Context, w io.Writer, r *Request) error {
 	maxSlices, err := h.SlicesMax()
 	if err != nil {
 		return errors.Wrap(err, "getting max slices")
@@ -139,9 +346,7 @@ func (h *Handler) Query(w io.Writer, r *Request) error {
 		return fmt.Errorf("getting schema: %v", err)
 	}
 
-	results := make(chan Bit, 0)
-
-	var eg errgroup.Group
+	var jobs []sliceJob
 	for _, i := range r.Indexes {
 		qry, err := buildQuery(schema, i, r)
 		if err != nil {
@@ -153,19 +358,16 @@ func (h *Handler) Query(w io.Writer, r *Request) error {
 			return errors.Errorf("index '%v' not found in max slices", i)
 		}
 		for sl := uint64(0); sl <= maxSlice; sl++ {
-			sl := sl // necessary since it's used in closure below.
-			eg.Go(func() error {
-				return h.sliceQuery(qry, sl, results)
-			})
+			jobs = append(jobs, sliceJob{index: i, qry: qry, slice: sl})
 		}
 	}
 
+	results := make(chan Bit, resultsBufferSize)
+
 	// read results off channel and write out.
 	writeErr := make(chan error, 1)
 	go func() {
-		defer func() {
-			close(writeErr) // TODO: need this closure?
-		}()
+		defer close(writeErr)
 		for bit := range results {
 			_, err := w.Write([]byte(fmt.Sprintf("%s,%d\n", bit.Index, bit.Col)))
 			if err != nil {
@@ -175,8 +377,16 @@ func (h *Handler) Query(w io.Writer, r *Request) error {
 		}
 	}()
 
-	// wait for sliceQuery routines to finish.
-	err = eg.Wait()
+	err = h.runSliceJobs(ctx, jobs, func(job sliceJob, result *pilosa.QueryResult) error {
+		for _, bit := range result.Bitmap.Bits {
+			select {
+			case results <- Bit{Index: job.index, Col: bit}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
 	// close results so that the result reader can finish.
 	close(results)
 	if err != nil {
@@ -187,21 +397,137 @@ func (h *Handler) Query(w io.Writer, r *Request) error {
 	return <-writeErr
 }
 
-// sliceQuery executes qry against a single slice in Pilosa.
-func (h *Handler) sliceQuery(qry *pilosa.PQLBitmapQuery, slice uint64, results chan<- Bit) error {
-	h.sem.Acquire()
-	response, err := h.client.Query(qry, pilosa.Slices(slice))
-	h.sem.Release()
+// queryCount issues a Count query per slice per index, summing the results
+// into a per-index total and a grand total, returned as JSON.
+func (h *Handler) queryCount(ctx context.Context, w io.Writer, r *Request) error {
+	maxSlices, err := h.SlicesMax()
 	if err != nil {
-		return fmt.Errorf("querying index %s: %v", qry.Index().Name(), err)
+		return errors.Wrap(err, "getting max slices")
 	}
-	// Since this isn't a batch query, there should be exactly one result.
-	if len(response.ResultList) != 1 {
-		return fmt.Errorf("expected 1 result but got %d", len(response.ResultList))
+
+	schema, err := h.client.Schema()
+	if err != nil {
+		return fmt.Errorf("getting schema: %v", err)
+	}
+
+	var jobs []sliceJob
+	for _, i := range r.Indexes {
+		qry, err := buildQuery(schema, i, r)
+		if err != nil {
+			return errors.Wrap(err, "building query")
+		}
+		index, err := schema.Index(i)
+		if err != nil {
+			return fmt.Errorf("getting index %s from schema: %v", i, err)
+		}
+		countQry := index.Count(qry)
+
+		maxSlice, ok := maxSlices[i]
+		if !ok {
+			return errors.Errorf("index '%v' not found in max slices", i)
+		}
+		for sl := uint64(0); sl <= maxSlice; sl++ {
+			jobs = append(jobs, sliceJob{index: i, qry: countQry, slice: sl})
+		}
+	}
+
+	var mu sync.Mutex
+	counts := make(map[string]uint64, len(r.Indexes))
+	err = h.runSliceJobs(ctx, jobs, func(job sliceJob, result *pilosa.QueryResult) error {
+		mu.Lock()
+		counts[job.index] += uint64(result.Count)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Counts map[string]uint64 `json:"counts"`
+		Total  uint64            `json:"total"`
+	}{Counts: counts, Total: total})
+}
+
+// queryTopN wraps each index's query in a TopN against r.TopNFrame, merges
+// the per-slice CountItem lists by row id, and streams the merged top r.TopN
+// rows per index as index,row,count CSV. A TopN of 0 or less means 10.
+func (h *Handler) queryTopN(ctx context.Context, w io.Writer, r *Request) error {
+	maxSlices, err := h.SlicesMax()
+	if err != nil {
+		return errors.Wrap(err, "getting max slices")
+	}
+
+	schema, err := h.client.Schema()
+	if err != nil {
+		return fmt.Errorf("getting schema: %v", err)
+	}
+
+	n := r.TopN
+	if n <= 0 {
+		n = 10
+	}
+	topN := uint64(n)
+
+	var jobs []sliceJob
+	merged := make(map[string]map[uint64]uint64, len(r.Indexes))
+	for _, i := range r.Indexes {
+		qry, err := buildQuery(schema, i, r)
+		if err != nil {
+			return errors.Wrap(err, "building query")
+		}
+		index, err := schema.Index(i)
+		if err != nil {
+			return fmt.Errorf("getting index %s from schema: %v", i, err)
+		}
+		frame, err := index.Frame(r.TopNFrame)
+		if err != nil {
+			return fmt.Errorf("getting topn frame %s from index %s: %v", r.TopNFrame, i, err)
+		}
+		topQry := frame.BitmapTopN(topN, qry)
+
+		maxSlice, ok := maxSlices[i]
+		if !ok {
+			return errors.Errorf("index '%v' not found in max slices", i)
+		}
+		merged[i] = make(map[uint64]uint64)
+		for sl := uint64(0); sl <= maxSlice; sl++ {
+			jobs = append(jobs, sliceJob{index: i, qry: topQry, slice: sl})
+		}
 	}
-	resp := response.ResultList[0]
-	for _, bit := range resp.Bitmap.Bits {
-		results <- Bit{Index: qry.Index().Name(), Col: bit}
+
+	var mu sync.Mutex
+	err = h.runSliceJobs(ctx, jobs, func(job sliceJob, result *pilosa.QueryResult) error {
+		mu.Lock()
+		for _, item := range result.CountItems {
+			merged[job.index][item.ID] += item.Count
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, i := range r.Indexes {
+		rows := merged[i]
+		list := make([]pilosa.CountResultItem, 0, len(rows))
+		for row, count := range rows {
+			list = append(list, pilosa.CountResultItem{ID: row, Count: count})
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].Count > list[b].Count })
+		if len(list) > n {
+			list = list[:n]
+		}
+		for _, item := range list {
+			if _, err := fmt.Fprintf(w, "%s,%d,%d\n", i, item.ID, item.Count); err != nil {
+				return errors.Wrap(err, "writing topn result")
+			}
+		}
 	}
 	return nil
 }
@@ -213,40 +539,251 @@ type Bit struct {
 	Col   uint64
 }
 
+// defaultImportBatchSize is used when Main.ImportBatchSize isn't set.
+const defaultImportBatchSize = 100000
+
+// sliceWidth is the number of columns per Pilosa slice. go-pilosa doesn't
+// export this (it's an internal constant on the Pilosa server side), so it's
+// mirrored here; it must match the target cluster's slice width.
+const sliceWidth = 1 << 20
+
+// ImportRecord is a single bit to set, destined for a specific index/frame.
+// The /mindy/import endpoint accepts a stream of these as newline-delimited
+// JSON or CSV.
+type ImportRecord struct {
+	Index string `json:"index"`
+	Frame string `json:"frame"`
+	Row   uint64 `json:"row"`
+	Col   uint64 `json:"col"`
+}
+
+func (h *Handler) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "must POST to /mindy/import", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.Import(r.Context(), r.Body, r.Header.Get("Content-Type")); err != nil {
+		http.Error(w, "importing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Import decodes records from body (newline-JSON, or CSV if contentType
+// mentions "csv") and fans them out to Pilosa, sharded by index, frame and
+// slice and batched to h.importBatchSize, with up to h.concurrency imports
+// running at once.
+func (h *Handler) Import(ctx context.Context, body io.Reader, contentType string) error {
+	records, err := decodeImportRecords(body, contentType)
+	if err != nil {
+		return errors.Wrap(err, "decoding import records")
+	}
+	return h.importRecords(ctx, records)
+}
+
+func decodeImportRecords(r io.Reader, contentType string) ([]ImportRecord, error) {
+	if strings.Contains(contentType, "csv") {
+		return decodeImportCSV(r)
+	}
+	return decodeImportNDJSON(r)
+}
+
+func decodeImportNDJSON(r io.Reader) ([]ImportRecord, error) {
+	var records []ImportRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec ImportRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, errors.Wrap(err, "unmarshaling import record")
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func decodeImportCSV(r io.Reader) ([]ImportRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	var records []ImportRecord
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading import csv")
+		}
+		row, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing import row")
+		}
+		col, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing import col")
+		}
+		records = append(records, ImportRecord{Index: fields[0], Frame: fields[1], Row: row, Col: col})
+	}
+	return records, nil
+}
+
+// importShard is a batch of bits for a single index/frame/slice, ready to
+// hand to Pilosa's import API.
+type importShard struct {
+	index string
+	frame *pilosa.Frame
+	slice uint64
+	bits  []pilosa.Bit
+}
+
+func (h *Handler) importRecords(ctx context.Context, records []ImportRecord) error {
+	schema, err := h.client.Schema()
+	if err != nil {
+		return fmt.Errorf("getting schema: %v", err)
+	}
+
+	type shardKey struct {
+		index, frame string
+		slice        uint64
+	}
+	bitsByShard := make(map[shardKey][]pilosa.Bit)
+	for _, rec := range records {
+		key := shardKey{index: rec.Index, frame: rec.Frame, slice: rec.Col / sliceWidth}
+		bitsByShard[key] = append(bitsByShard[key], pilosa.Bit{RowID: rec.Row, ColumnID: rec.Col})
+	}
+
+	batchSize := h.importBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	frames := make(map[string]*pilosa.Frame)
+	var shards []importShard
+	for key, bits := range bitsByShard {
+		frameKey := key.index + "/" + key.frame
+		frame, ok := frames[frameKey]
+		if !ok {
+			index, err := schema.Index(key.index)
+			if err != nil {
+				return fmt.Errorf("getting index %s from schema: %v", key.index, err)
+			}
+			frame, err = index.Frame(key.frame)
+			if err != nil {
+				return fmt.Errorf("getting frame %s from index %s: %v", key.frame, key.index, err)
+			}
+			frames[frameKey] = frame
+		}
+		for start := 0; start < len(bits); start += batchSize {
+			end := start + batchSize
+			if end > len(bits) {
+				end = len(bits)
+			}
+			shards = append(shards, importShard{index: key.index, frame: frame, slice: key.slice, bits: bits[start:end]})
+		}
+	}
+
+	return h.runImportShards(ctx, shards)
+}
+
+// runImportShards imports shards across a fixed pool of h.concurrency
+// workers, mirroring runSliceJobs: the first error cancels ctx so idle
+// workers stop picking up new shards instead of each completing a full
+// import round trip before the error is observed.
+func (h *Handler) runImportShards(ctx context.Context, shards []importShard) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shardCh := make(chan importShard)
+	go func() {
+		defer close(shardCh)
+		for _, s := range shards {
+			select {
+			case shardCh <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	workers := h.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var eg errgroup.Group
+	for w := 0; w < workers; w++ {
+		eg.Go(func() error {
+			for shard := range shardCh {
+				err := h.client.ImportFrame(shard.frame, &bitSliceIterator{bits: shard.bits}, uint(len(shard.bits)))
+				if err != nil {
+					cancel()
+					return fmt.Errorf("importing index %s frame %s slice %d: %v", shard.index, shard.frame.Name(), shard.slice, err)
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// bitSliceIterator adapts a []pilosa.Bit to the pilosa.BitIterator interface
+// expected by Client.ImportFrame.
+type bitSliceIterator struct {
+	bits []pilosa.Bit
+	i    int
+}
+
+func (it *bitSliceIterator) NextBit() (pilosa.Bit, error) {
+	if it.i >= len(it.bits) {
+		return pilosa.Bit{}, io.EOF
+	}
+	b := it.bits[it.i]
+	it.i++
+	return b, nil
+}
+
 // buildQuery constructs a Pilosa query from the Request.
 func buildQuery(schema *pilosa.Schema, idx string, r *Request) (*pilosa.PQLBitmapQuery, error) {
 	index, err := schema.Index(idx)
 	if err != nil {
 		return nil, fmt.Errorf("getting index %s from schema: %v", idx, err)
 	}
+	return buildIndexQuery(index, r)
+}
 
+// buildIndexQuery constructs a Pilosa query for r against index, recursing
+// into any nested Row.Group subtrees.
+func buildIndexQuery(index *pilosa.Index, r *Request) (*pilosa.PQLBitmapQuery, error) {
 	// Includes.
 	var includes []*pilosa.PQLBitmapQuery
 	for _, row := range r.Includes {
-		frame, err := index.Frame(row.Frame)
+		q, err := rowQuery(index, row)
 		if err != nil {
-			return nil, fmt.Errorf("getting frame %s from index %s: %v", row.Frame, idx, err)
+			return nil, err
 		}
-		includes = append(includes, frame.Bitmap(row.ID))
+		includes = append(includes, q)
 	}
 
 	// Excludes.
 	var excludes []*pilosa.PQLBitmapQuery
 	for _, row := range r.Excludes {
-		frame, err := index.Frame(row.Frame)
+		q, err := rowQuery(index, row)
 		if err != nil {
-			return nil, fmt.Errorf("getting frame %s from index %s: %v", row.Frame, idx, err)
+			return nil, err
 		}
-		excludes = append(excludes, frame.Bitmap(row.ID))
+		excludes = append(excludes, q)
 	}
 
-	// Conjuction: Intersect, Union.
+	// Conjuction: Intersect, Union, Xor.
 	var qry *pilosa.PQLBitmapQuery
 	switch r.Conjunction {
 	case "and":
 		qry = index.Intersect(includes...)
 	case "or":
 		qry = index.Union(includes...)
+	case "xor":
+		qry = index.Xor(includes...)
 	default:
 		return nil, fmt.Errorf("invalid conjunction: %s", r.Conjunction)
 	}
@@ -264,10 +801,78 @@ func buildQuery(schema *pilosa.Schema, idx string, r *Request) (*pilosa.PQLBitma
 	return qry, nil
 }
 
-// SlicesMax returns a map with keys of all indexes in Pilosa, and values of the
-// maximum slice in that index. This method may(TODO) cache the response for a
-// short time to avoid many redundant requests to Pilosa for this information.
+// rowQuery constructs the bitmap query for a single Row: a nested group, a
+// range-encoded field comparison, or a plain bitmap row, in that order of
+// precedence.
+func rowQuery(index *pilosa.Index, row Row) (*pilosa.PQLBitmapQuery, error) {
+	if row.Group != nil {
+		return buildIndexQuery(index, row.Group)
+	}
+
+	frame, err := index.Frame(row.Frame)
+	if err != nil {
+		return nil, fmt.Errorf("getting frame %s from index %s: %v", row.Frame, index.Name(), err)
+	}
+
+	if row.Field == "" {
+		return frame.Bitmap(row.ID), nil
+	}
+
+	field := frame.Field(row.Field)
+	switch row.Op {
+	case "<":
+		return field.LT(row.Value), nil
+	case "<=":
+		return field.LTE(row.Value), nil
+	case ">":
+		return field.GT(row.Value), nil
+	case ">=":
+		return field.GTE(row.Value), nil
+	case "==":
+		// go-pilosa has no native field equality query; a single-point
+		// range is equivalent.
+		return field.Between(row.Value, row.Value), nil
+	case "><":
+		return field.Between(row.ValueMin, row.ValueMax), nil
+	case "!=":
+		return nil, fmt.Errorf("field op != is not supported: go-pilosa has no native field inequality query")
+	default:
+		return nil, fmt.Errorf("invalid field op: %s", row.Op)
+	}
+}
+
+// SlicesMax returns a map with keys of all indexes in Pilosa, and values of
+// the maximum slice in that index. The result is cached for slicesMaxTTL;
+// concurrent callers that find the cache expired coalesce onto a single
+// upstream request via slicesMaxSF.
 func (h *Handler) SlicesMax() (map[string]uint64, error) {
+	h.slicesMaxMu.Lock()
+	cached, at := h.slicesMax, h.slicesMaxAt
+	h.slicesMaxMu.Unlock()
+	if cached != nil && time.Since(at) < h.slicesMaxTTL {
+		return cached, nil
+	}
+
+	v, err, _ := h.slicesMaxSF.Do("slicesMax", func() (interface{}, error) {
+		sm, err := h.fetchSlicesMax()
+		if err != nil {
+			return nil, err
+		}
+		h.slicesMaxMu.Lock()
+		h.slicesMax = sm
+		h.slicesMaxAt = time.Now()
+		h.slicesMaxMu.Unlock()
+		log.Printf("mindy: refreshed slices max cache for %d indexes", len(sm))
+		return sm, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]uint64), nil
+}
+
+// fetchSlicesMax makes the actual GET /slices/max request against Pilosa.
+func (h *Handler) fetchSlicesMax() (map[string]uint64, error) {
 	_, data, err := h.client.HttpRequest("GET", "/slices/max", nil, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "slices max request")
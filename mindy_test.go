@@ -1,10 +1,14 @@
 package mindy
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync/atomic"
 	"testing"
 
 	"github.com/pilosa/go-pilosa"
+	"github.com/pkg/errors"
 
 	ptest "github.com/pilosa/pilosa/test"
 )
@@ -43,6 +47,52 @@ func TestMindy(t *testing.T) {
 				iss{"p3", 3, 6},
 			),
 		},
+		{
+			// go-pilosa's Xor requires at least 2 bitmaps, so this exercises
+			// a genuine symmetric difference between p3's f1 rows 1 (step 4)
+			// and 4 (step 7).
+			req: &Request{
+				Indexes:     []string{"p3"},
+				Includes:    []Row{{ID: 1, Frame: "f1"}, {ID: 4, Frame: "f1"}},
+				Excludes:    []Row{},
+				Conjunction: "xor",
+			},
+			expected: xorBits("p3", 4, 7),
+		},
+		{
+			// Mode "count" returns a single JSON line instead of bits CSV;
+			// the comparison loop doesn't care which, as long as the line
+			// is byte-for-byte what's expected.
+			req: &Request{
+				Indexes:     []string{"p3"},
+				Includes:    []Row{{ID: 4, Frame: "f1"}},
+				Excludes:    []Row{},
+				Conjunction: "and",
+				Mode:        "count",
+			},
+			expected: map[string]struct{}{
+				`{"counts":{"p3":15},"total":15}`: {},
+			},
+		},
+		{
+			// Mode "topn" against frame f2, restricted to the columns of
+			// p4's f1 row 1 (multiples of 5). Only f2 rows 1 and 3 have any
+			// bits in common with that set (rows 0, 2 and 4 are all-even
+			// and so never overlap f2's odd-only bits).
+			req: &Request{
+				Indexes:     []string{"p4"},
+				Includes:    []Row{{ID: 1, Frame: "f1"}},
+				Excludes:    []Row{},
+				Conjunction: "and",
+				Mode:        "topn",
+				TopN:        10,
+				TopNFrame:   "f2",
+			},
+			expected: map[string]struct{}{
+				"p4,1,10": {},
+				"p4,3,1":  {},
+			},
+		},
 	}
 
 	for i, test := range tests {
@@ -63,6 +113,148 @@ func TestMindy(t *testing.T) {
 	}
 }
 
+// TestMindyQueryError checks that an error from process during runSliceJobs
+// cancels the job pool instead of letting every sibling job run to
+// completion first.
+func TestMindyQueryError(t *testing.T) {
+	server := ptest.MustNewRunningServer(t)
+	populate(t, server.Server.Addr().String())
+
+	client, err := pilosa.NewClientFromAddresses([]string{server.Server.Addr().String()}, nil)
+	if err != nil {
+		t.Fatalf("getting client: %v", err)
+	}
+	schema, err := client.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index, err := schema.Index("p1")
+	if err != nil {
+		t.Fatalf("getting index: %v", err)
+	}
+	frame, err := index.Frame("f1")
+	if err != nil {
+		t.Fatalf("getting frame: %v", err)
+	}
+	qry := frame.Bitmap(0)
+
+	h := &Handler{client: client, concurrency: 1}
+	jobs := make([]sliceJob, 10)
+	for i := range jobs {
+		jobs[i] = sliceJob{index: "p1", qry: qry, slice: 0}
+	}
+
+	wantErr := errors.New("boom")
+	var processed int32
+	err = h.runSliceJobs(context.Background(), jobs, func(job sliceJob, result *pilosa.QueryResult) error {
+		atomic.AddInt32(&processed, 1)
+		return wantErr
+	})
+	if errors.Cause(err) != wantErr {
+		t.Fatalf("expected wantErr, got: %v", err)
+	}
+	if n := atomic.LoadInt32(&processed); n >= int32(len(jobs)) {
+		t.Fatalf("expected runSliceJobs to cancel before processing all %d jobs, but processed %d", len(jobs), n)
+	}
+}
+
+// TestMindyRefresh checks that POSTing /mindy/refresh invalidates the cached
+// SlicesMax and succeeds in repopulating it from Pilosa.
+func TestMindyRefresh(t *testing.T) {
+	server := ptest.MustNewRunningServer(t)
+	populate(t, server.Server.Addr().String())
+
+	m := NewMain()
+	m.Pilosa = []string{server.Server.Addr().String()}
+	m.Bind = "localhost:33334"
+	err := m.listen()
+	if err != nil {
+		t.Fatalf("m.listen: %v", err)
+	}
+
+	go m.serve()
+
+	resp, err := http.Post("http://"+m.Bind+"/mindy/refresh", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatalf("posting refresh: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+// TestMindyImport round-trips bits through Client.Import and reads them back
+// via Client.Post, exercising importRecords' sharding and runImportShards'
+// worker pool end to end.
+func TestMindyImport(t *testing.T) {
+	server := ptest.MustNewRunningServer(t)
+	populate(t, server.Server.Addr().String())
+
+	rawClient, err := pilosa.NewClientFromAddresses([]string{server.Server.Addr().String()}, nil)
+	if err != nil {
+		t.Fatalf("getting client: %v", err)
+	}
+	sch, err := rawClient.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index, err := sch.Index("p1", nil)
+	if err != nil {
+		t.Fatalf("getting index: %v", err)
+	}
+	if _, err := index.Frame("imp", nil); err != nil {
+		t.Fatalf("getting frame: %v", err)
+	}
+	if err := rawClient.SyncSchema(sch); err != nil {
+		t.Fatalf("syncing schema: %v", err)
+	}
+
+	m := NewMain()
+	m.Pilosa = []string{server.Server.Addr().String()}
+	m.Bind = "localhost:33336"
+	if err := m.listen(); err != nil {
+		t.Fatalf("m.listen: %v", err)
+	}
+
+	go m.serve()
+
+	client := Client{
+		Addr: m.Bind,
+	}
+
+	records := []ImportRecord{
+		{Index: "p1", Frame: "imp", Row: 0, Col: 5},
+		{Index: "p1", Frame: "imp", Row: 0, Col: 10},
+	}
+	if err := client.Import(records); err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+
+	scanner, err := client.Post(&Request{
+		Indexes:     []string{"p1"},
+		Includes:    []Row{{ID: 0, Frame: "imp"}},
+		Excludes:    []Row{},
+		Conjunction: "and",
+	})
+	if err != nil {
+		t.Fatalf("making request: %v", err)
+	}
+	expected := map[string]struct{}{
+		"p1,5":  {},
+		"p1,10": {},
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, ok := expected[line]; !ok {
+			t.Fatalf("'%s' in response, but not expected", line)
+		}
+		delete(expected, line)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("leftover items in expected: %v", expected)
+	}
+}
+
 func populate(t *testing.T, host string) {
 	client, err := pilosa.NewClientFromAddresses([]string{host}, nil)
 	if err != nil {
@@ -125,3 +317,23 @@ func bits(specs ...iss) map[string]struct{} {
 	}
 	return idxs
 }
+
+// xorBits computes the symmetric difference, over [0,100), of the
+// zero-based arithmetic sequences given by steps (matching populate's
+// bit-setting pattern), returning the columns that appear in an odd number
+// of them.
+func xorBits(index string, steps ...uint64) map[string]struct{} {
+	counts := make(map[uint64]int)
+	for _, step := range steps {
+		for i := uint64(0); i < 100; i += step {
+			counts[i]++
+		}
+	}
+	idxs := make(map[string]struct{})
+	for i, c := range counts {
+		if c%2 == 1 {
+			idxs[fmt.Sprintf("%s,%d", index, i)] = struct{}{}
+		}
+	}
+	return idxs
+}